@@ -0,0 +1,154 @@
+package conveyor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// AuthFn resolves the docker credentials that should be tried, in order, for
+// pushing or pulling images from the registry that hosts repository.
+type AuthFn func(repository string) ([]docker.AuthConfiguration, error)
+
+// defaultAuthFn returns an AuthFn that resolves credentials from the docker
+// cli's config.json (~/.docker/config.json), including credHelpers and
+// credsStore entries. This lets a single conveyor instance pull base images
+// from one registry (e.g. gcr.io) and push to another (e.g. ECR).
+func defaultAuthFn() AuthFn {
+	cfg, err := loadDockerConfig()
+	return func(repository string) ([]docker.AuthConfiguration, error) {
+		if err != nil {
+			return nil, fmt.Errorf("load docker config: %v", err)
+		}
+		return cfg.authConfigurations(registryHost(repository))
+	}
+}
+
+// dockerConfig is the subset of ~/.docker/config.json that we care about.
+type dockerConfig struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+	CredsStore  string                      `json:"credsStore"`
+}
+
+type dockerConfigAuth struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func loadDockerConfig() (*dockerConfig, error) {
+	home := os.Getenv("HOME")
+	if home == "" {
+		if u, err := user.Current(); err == nil {
+			home = u.HomeDir
+		}
+	}
+
+	path := filepath.Join(home, ".docker", "config.json")
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &dockerConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg dockerConfig
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+
+	return &cfg, nil
+}
+
+// authConfigurations returns the credentials that should be tried, in
+// order, for the given registry host. A credHelper/credsStore entry is
+// tried first, falling back to a plaintext auths entry.
+func (c *dockerConfig) authConfigurations(host string) ([]docker.AuthConfiguration, error) {
+	var configs []docker.AuthConfiguration
+
+	if helper, ok := c.CredHelpers[host]; ok {
+		auth, err := execCredHelper(helper, host)
+		if err != nil {
+			return nil, fmt.Errorf("cred helper %s: %v", helper, err)
+		}
+		configs = append(configs, auth)
+	} else if c.CredsStore != "" {
+		if auth, err := execCredHelper(c.CredsStore, host); err == nil {
+			configs = append(configs, auth)
+		}
+	}
+
+	if entry, ok := c.Auths[host]; ok {
+		auth, err := entry.authConfiguration()
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, auth)
+	}
+
+	return configs, nil
+}
+
+func (e dockerConfigAuth) authConfiguration() (docker.AuthConfiguration, error) {
+	if e.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(e.Auth)
+		if err != nil {
+			return docker.AuthConfiguration{}, fmt.Errorf("decode auth: %v", err)
+		}
+
+		username, password := decoded, []byte(nil)
+		if i := strings.IndexByte(string(decoded), ':'); i >= 0 {
+			username, password = decoded[:i], decoded[i+1:]
+		}
+
+		return docker.AuthConfiguration{Username: string(username), Password: string(password)}, nil
+	}
+
+	return docker.AuthConfiguration{Username: e.Username, Password: e.Password}, nil
+}
+
+// execCredHelper shells out to the docker-credential-<helper> binary, using
+// the same get protocol the docker CLI uses for credsStore/credHelpers.
+func execCredHelper(helper, host string) (docker.AuthConfiguration, error) {
+	cmd := exec.Command(fmt.Sprintf("docker-credential-%s", helper), "get")
+	cmd.Stdin = strings.NewReader(host)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return docker.AuthConfiguration{}, err
+	}
+
+	var resp struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return docker.AuthConfiguration{}, err
+	}
+
+	return docker.AuthConfiguration{Username: resp.Username, Password: resp.Secret}, nil
+}
+
+// registryHost returns the registry hostname that a repository reference
+// belongs to, e.g. "gcr.io" for "gcr.io/my-project/my-image", and the
+// default docker hub host for "my-org/my-image".
+func registryHost(repository string) string {
+	repo, _ := docker.ParseRepositoryTag(repository)
+
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0]
+	}
+
+	return "https://index.docker.io/v1/"
+}
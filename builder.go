@@ -0,0 +1,130 @@
+package conveyor
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/fsouza/go-dockerclient"
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/progress/progressui"
+	"golang.org/x/sync/errgroup"
+)
+
+// Builder builds a docker image from the contents of dir, returning the id
+// of the resulting image.
+type Builder interface {
+	Build(ctx context.Context, dir string, opts BuildOptions) (imageID string, err error)
+}
+
+// DockerCLIBuilder is a Builder implementation that shells out to the docker
+// CLI. It's used instead of the docker client because the CLI handles
+// .dockerignore.
+type DockerCLIBuilder struct {
+	docker *docker.Client
+}
+
+func newDockerCLIBuilder(c *docker.Client) *DockerCLIBuilder {
+	return &DockerCLIBuilder{docker: c}
+}
+
+func (b *DockerCLIBuilder) Build(ctx context.Context, dir string, opts BuildOptions) (string, error) {
+	cmd := exec.CommandContext(ctx, "docker", "build", "-t", opts.Repository, ".")
+	cmd.Dir = dir
+	cmd.Stdout = opts.OutputStream
+	cmd.Stderr = opts.OutputStream
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+
+	image, err := b.docker.InspectImage(opts.Repository)
+	if err != nil {
+		return "", err
+	}
+
+	return image.ID, nil
+}
+
+// BuildKitBuilder is a Builder implementation that builds images by talking
+// to a buildkitd daemon over gRPC, which lets conveyor run in rootless or
+// daemonless environments. The buildkitd endpoint is configured with the
+// BUILDKIT_HOST environment variable (e.g. tcp://buildkitd:1234 or
+// unix:///run/buildkit/buildkitd.sock). The resulting image is loaded into
+// the local docker daemon, since every later build step (postBuild, Squash,
+// tag, push) talks to it rather than to buildkitd.
+type BuildKitBuilder struct {
+	// Host is the buildkitd endpoint to connect to. Defaults to the
+	// BUILDKIT_HOST environment variable.
+	Host string
+
+	docker *docker.Client
+}
+
+func NewBuildKitBuilder(c *docker.Client) *BuildKitBuilder {
+	return &BuildKitBuilder{
+		Host:   os.Getenv("BUILDKIT_HOST"),
+		docker: c,
+	}
+}
+
+func (b *BuildKitBuilder) Build(ctx context.Context, dir string, opts BuildOptions) (string, error) {
+	bc, err := bkclient.New(ctx, b.Host, bkclient.WithFailFast())
+	if err != nil {
+		return "", err
+	}
+	defer bc.Close()
+
+	pr, pw := io.Pipe()
+	ch := make(chan *bkclient.SolveStatus)
+	eg, ctx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		_, err := bc.Solve(ctx, nil, bkclient.SolveOpt{
+			Frontend: "dockerfile.v0",
+			FrontendAttrs: map[string]string{
+				"filename": "Dockerfile",
+			},
+			LocalDirs: map[string]string{
+				"context":    dir,
+				"dockerfile": dir,
+			},
+			Exports: []bkclient.ExportEntry{
+				{
+					Type: bkclient.ExporterDocker,
+					Attrs: map[string]string{
+						"name": opts.Repository,
+					},
+					Output: func(map[string]string) (io.WriteCloser, error) {
+						return pw, nil
+					},
+				},
+			},
+		}, ch)
+		pw.CloseWithError(err)
+		return err
+	})
+
+	eg.Go(func() error {
+		_, err := progressui.DisplaySolveStatus(ctx, "", nil, opts.OutputStream, ch)
+		return err
+	})
+
+	eg.Go(func() error {
+		return b.docker.LoadImage(docker.LoadImageOptions{
+			Context:     ctx,
+			InputStream: pr,
+		})
+	})
+
+	if err := eg.Wait(); err != nil {
+		return "", err
+	}
+
+	image, err := b.docker.InspectImage(opts.Repository)
+	if err != nil {
+		return "", err
+	}
+
+	return image.ID, nil
+}
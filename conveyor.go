@@ -1,6 +1,7 @@
 package conveyor
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,15 +10,19 @@ import (
 	"regexp"
 	"strings"
 
-	"golang.org/x/oauth2"
-
 	"github.com/fsouza/go-dockerclient"
 	"github.com/google/go-github/github"
 	"github.com/remind101/empire/pkg/dockerutil"
 )
 
-// Context is used for the commit status context.
-const Context = "container/docker"
+// Commit status contexts. Each stage of the build reports its own status,
+// rather than a single coarse "container/docker" context, so failures can
+// be diagnosed from the stage that reported them in the GitHub PR UI.
+const (
+	ContextCheckout = "container/docker/checkout"
+	ContextBuild    = "container/docker/build"
+	ContextPush     = "container/docker/push"
+)
 
 type BuildOptions struct {
 	// Repository is the repo to build.
@@ -26,6 +31,21 @@ type BuildOptions struct {
 	Commit string
 	// Branch is the name of the branch that this build relates to.
 	Branch string
+	// PostBuild, if set, is a shell command that's run inside a
+	// container started from the newly built image. A non-zero exit
+	// status fails the build with a `failure` status, as opposed to
+	// `error` for infrastructure failures.
+	PostBuild string
+	// Squash, if true, flattens the built image down to a single layer
+	// before it's tagged and pushed.
+	Squash bool
+	// LogURL is linked to from the commit status as the target_url, so
+	// that a failure can be diagnosed from the GitHub PR page without
+	// digging through the build system. If Conveyor.Logs is set, Build
+	// populates this automatically from the log it creates for the
+	// build; set it explicitly to override that, or when Conveyor.Logs
+	// is nil.
+	LogURL string
 	// An io.Writer where output will be written to.
 	OutputStream io.Writer
 }
@@ -33,9 +53,20 @@ type BuildOptions struct {
 type Conveyor struct {
 	// BuildDir is the directory where repositories will be cloned.
 	BuildDir string
-	// AuthConfiguration is the docker authentication credentials for
-	// pushing and pulling images from the registry.
-	AuthConfiguration docker.AuthConfiguration
+	// AuthFn resolves the docker authentication credentials to try, in
+	// order, for pushing and pulling images from the registry that
+	// hosts a given repository. Defaults to a resolver that reads
+	// ~/.docker/config.json.
+	AuthFn AuthFn
+	// Squasher is used to flatten images when BuildOptions.Squash is set.
+	Squasher Squasher
+	// Builder builds the docker image from the checked out repository.
+	// Defaults to DockerCLIBuilder.
+	Builder Builder
+	// Logs, if set, is used to create a log for each build, tee output
+	// to it alongside BuildOptions.OutputStream, and populate
+	// BuildOptions.LogURL from it.
+	Logs Logs
 	// docker client for interacting with the docker daemon api.
 	docker *docker.Client
 	// github client for creating commit statuses.
@@ -50,92 +81,171 @@ func NewFromEnv() (*Conveyor, error) {
 		return nil, err
 	}
 
-	u, p := os.Getenv("DOCKER_USERNAME"), os.Getenv("DOCKER_PASSWORD")
-	auth := docker.AuthConfiguration{
-		Username: u,
-		Password: p,
+	authFn := defaultAuthFn()
+	if u, p := os.Getenv("DOCKER_USERNAME"), os.Getenv("DOCKER_PASSWORD"); u != "" || p != "" {
+		auth := docker.AuthConfiguration{Username: u, Password: p}
+		authFn = func(repository string) ([]docker.AuthConfiguration, error) {
+			return []docker.AuthConfiguration{auth}, nil
+		}
 	}
 
 	return &Conveyor{
-		BuildDir:          os.Getenv("BUILD_DIR"),
-		AuthConfiguration: auth,
-		github:            newGitHubClient(os.Getenv("GITHUB_TOKEN")),
-		docker:            c,
+		BuildDir: os.Getenv("BUILD_DIR"),
+		AuthFn:   authFn,
+		Squasher: newDockerSquasher(c),
+		Builder:  newDockerCLIBuilder(c),
+		github:   newGitHubClientFromEnv(),
+		docker:   c,
 	}, nil
 }
 
-// Build builds a docker image for the
-func (c *Conveyor) Build(opts BuildOptions) (err error) {
-	defer func() {
-		status := "success"
-		if err != nil {
-			status = "error"
-		}
-		c.updateStatus(opts.Repository, opts.Commit, status)
-	}()
-
+// Build builds a docker image for the repository and commit described by
+// opts. ctx can be used to cancel a build in progress; the checked out
+// repository, running containers, and the docker build itself are all torn
+// down when ctx is canceled.
+func (c *Conveyor) Build(ctx context.Context, opts BuildOptions) (err error) {
 	var dir string
 	dir, err = ioutil.TempDir(c.BuildDir, opts.Commit)
 	if err != nil {
 		return fmt.Errorf("tempdir: %v", err)
 	}
+	defer os.RemoveAll(dir)
+
+	if c.Logs != nil {
+		name := logName(opts)
+
+		logs, err := c.Logs.Create(name)
+		if err != nil {
+			return fmt.Errorf("create log: %v", err)
+		}
+		defer logs.Close()
 
-	if err = c.updateStatus(opts.Repository, opts.Commit, "pending"); err != nil {
+		if opts.OutputStream != nil {
+			opts.OutputStream = io.MultiWriter(opts.OutputStream, logs)
+		} else {
+			opts.OutputStream = logs
+		}
+
+		if opts.LogURL == "" {
+			opts.LogURL = c.Logs.URL(name)
+		}
+	}
+
+	if err = c.setStatus(opts, ContextCheckout, "pending", "Cloning the repository"); err != nil {
 		return fmt.Errorf("status: %v", err)
 	}
 
-	if err = c.checkout(dir, opts); err != nil {
+	if err = c.checkout(ctx, dir, opts); err != nil {
+		c.stageFailed(ctx, opts, ContextCheckout, "Failed to clone the repository")
 		return fmt.Errorf("checkout: %v", err)
 	}
+	c.setStatus(opts, ContextCheckout, "success", "Cloned the repository")
 
-	if err = c.pull(opts); err != nil {
+	if err = c.setStatus(opts, ContextBuild, "pending", "Building the image"); err != nil {
+		return fmt.Errorf("status: %v", err)
+	}
+
+	if err = c.pull(ctx, opts); err != nil {
+		c.stageFailed(ctx, opts, ContextBuild, "Failed to pull the previous image")
 		return fmt.Errorf("pull: %v", err)
 	}
 
-	if _, err = c.build(dir, opts); err != nil {
+	imageID, err := c.Builder.Build(ctx, dir, opts)
+	if err != nil {
+		c.stageFailed(ctx, opts, ContextBuild, "Build failed")
 		return fmt.Errorf("build: %v", err)
 	}
 
+	if opts.PostBuild != "" {
+		if err = c.postBuild(ctx, imageID, opts); err != nil {
+			if ctx.Err() != nil {
+				c.stageFailed(ctx, opts, ContextBuild, "Post-build command failed")
+			} else if _, ok := err.(*postBuildExitError); ok {
+				c.setStatus(opts, ContextBuild, "failure", "Post-build command failed")
+			} else {
+				c.setStatus(opts, ContextBuild, "error", "Post-build command failed")
+			}
+			return fmt.Errorf("postbuild: %v", err)
+		}
+	}
+
+	if opts.Squash {
+		squashedID, err := c.Squasher.Squash(ctx, imageID, opts.OutputStream)
+		if err != nil {
+			c.stageFailed(ctx, opts, ContextBuild, "Failed to squash the image")
+			return fmt.Errorf("squash: %v", err)
+		}
+
+		if err := c.docker.TagImage(squashedID, docker.TagImageOptions{
+			Repo:  opts.Repository,
+			Tag:   "latest",
+			Force: true,
+		}); err != nil {
+			c.stageFailed(ctx, opts, ContextBuild, "Failed to tag the squashed image")
+			return fmt.Errorf("tag squashed image: %v", err)
+		}
+	}
+
 	tags := []string{
 		opts.Branch,
 		opts.Commit,
 	}
 
 	if err = c.tag(opts.Repository, tags...); err != nil {
+		c.stageFailed(ctx, opts, ContextBuild, "Failed to tag the image")
 		return fmt.Errorf("tag: %v", err)
 	}
+	c.setStatus(opts, ContextBuild, "success", "Built the image")
+
+	if err = c.setStatus(opts, ContextPush, "pending", "Pushing the image"); err != nil {
+		return fmt.Errorf("status: %v", err)
+	}
 
-	if err = c.push(opts.Repository, opts.OutputStream, append([]string{"latest"}, tags...)...); err != nil {
+	if err = c.push(ctx, opts.Repository, opts.OutputStream, append([]string{"latest"}, tags...)...); err != nil {
+		c.stageFailed(ctx, opts, ContextPush, "Push failed")
 		return fmt.Errorf("push: %v", err)
 	}
+	c.setStatus(opts, ContextPush, "success", "Pushed the image")
 
 	return nil
 }
 
+// stageFailed reports a build stage as failed. If ctx was canceled, the
+// description reflects that instead of the stage-specific failure reason,
+// so a cancelled build is distinguishable from a genuine failure in the
+// GitHub PR UI even though the commit status API has no dedicated
+// "cancelled" state.
+func (c *Conveyor) stageFailed(ctx context.Context, opts BuildOptions, context, description string) {
+	if ctx.Err() != nil {
+		description = "Build was cancelled"
+	}
+	c.setStatus(opts, context, "error", description)
+}
+
 // checkout clones the repo and checks out the given commit.
-func (c *Conveyor) checkout(dir string, opts BuildOptions) error {
-	cmd := newCommand(opts.OutputStream, "git", "clone", "--depth=50", fmt.Sprintf("--branch=%s", opts.Branch), fmt.Sprintf("git://github.com/%s.git", opts.Repository), dir)
+func (c *Conveyor) checkout(ctx context.Context, dir string, opts BuildOptions) error {
+	cmd := newCommandContext(ctx, opts.OutputStream, "git", "clone", "--depth=50", fmt.Sprintf("--branch=%s", opts.Branch), fmt.Sprintf("git://github.com/%s.git", opts.Repository), dir)
 	cmd.Dir = c.BuildDir
 	if err := cmd.Run(); err != nil {
 		return err
 	}
 
-	cmd = newCommand(opts.OutputStream, "git", "checkout", "-qf", opts.Commit)
+	cmd = newCommandContext(ctx, opts.OutputStream, "git", "checkout", "-qf", opts.Commit)
 	cmd.Dir = dir
 	return cmd.Run()
 }
 
 // pull pulls the last docker image for the branch.
 // TODO: try: branch -> latest
-func (c *Conveyor) pull(opts BuildOptions) error {
-	return c.pullTags(opts.Repository, opts.OutputStream, opts.Branch, "latest")
+func (c *Conveyor) pull(ctx context.Context, opts BuildOptions) error {
+	return c.pullTags(ctx, opts.Repository, opts.OutputStream, opts.Branch, "latest")
 }
 
 // pullTags attempts to pull each tag. It will return when the first pull
 // succeeds or when none of the pulls succeed.
-func (c *Conveyor) pullTags(repo string, w io.Writer, tags ...string) (err error) {
+func (c *Conveyor) pullTags(ctx context.Context, repo string, w io.Writer, tags ...string) (err error) {
 	for _, t := range tags {
-		if err = c.pullTag(repo, t, w); err != nil {
+		if err = c.pullTag(ctx, repo, t, w); err != nil {
 			if tagNotFound(err) {
 				// Try next tag.
 				continue
@@ -147,36 +257,130 @@ func (c *Conveyor) pullTags(repo string, w io.Writer, tags ...string) (err error
 	return
 }
 
-func (c *Conveyor) pullTag(repo, tag string, w io.Writer) error {
-	return c.docker.PullImage(docker.PullImageOptions{
-		Repository:   repo,
-		Tag:          tag,
-		OutputStream: w,
-	}, c.AuthConfiguration)
+func (c *Conveyor) pullTag(ctx context.Context, repo, tag string, w io.Writer) (err error) {
+	auths, err := c.AuthFn(repo)
+	if err != nil {
+		return fmt.Errorf("auth: %v", err)
+	}
+	if len(auths) == 0 {
+		auths = []docker.AuthConfiguration{{}}
+	}
+
+	for _, auth := range auths {
+		err = c.docker.PullImage(docker.PullImageOptions{
+			Context:      ctx,
+			Repository:   repo,
+			Tag:          tag,
+			OutputStream: w,
+		}, auth)
+		if !unauthorized(err) {
+			return err
+		}
+	}
+
+	return err
 }
 
-// build builds the docker image.
-// TODO: Build using the docker client. We build this by shelling out because
-// the docker CLI handles .dockerignore.
-func (c *Conveyor) build(dir string, opts BuildOptions) (*docker.Image, error) {
-	cmd := newCommand(opts.OutputStream, "docker", "build", "-t", opts.Repository, ".")
-	cmd.Dir = dir
-	if err := cmd.Run(); err != nil {
-		return nil, err
+// postBuild runs opts.PostBuild inside an ephemeral container started from
+// the built image, streaming its output to opts.OutputStream. A non-zero
+// exit status results in an error. Canceling ctx stops the container and
+// returns ctx.Err().
+func (c *Conveyor) postBuild(ctx context.Context, imageID string, opts BuildOptions) error {
+	container, err := c.docker.CreateContainer(docker.CreateContainerOptions{
+		Context: ctx,
+		Config: &docker.Config{
+			Image: imageID,
+			Cmd:   []string{"/bin/sh", "-c", opts.PostBuild},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("create container: %v", err)
+	}
+	defer c.docker.RemoveContainer(docker.RemoveContainerOptions{
+		ID:    container.ID,
+		Force: true,
+	})
+
+	attached := make(chan error, 1)
+	go func() {
+		attached <- c.docker.AttachToContainer(docker.AttachToContainerOptions{
+			Container:    container.ID,
+			OutputStream: opts.OutputStream,
+			ErrorStream:  opts.OutputStream,
+			Logs:         true,
+			Stdout:       true,
+			Stderr:       true,
+			Stream:       true,
+		})
+	}()
+
+	if err := c.docker.StartContainer(container.ID, nil); err != nil {
+		return fmt.Errorf("start container: %v", err)
 	}
 
-	return c.docker.InspectImage(opts.Repository)
+	waitStatus := make(chan int, 1)
+	waitErr := make(chan error, 1)
+	go func() {
+		exitCode, err := c.docker.WaitContainer(container.ID)
+		if err != nil {
+			waitErr <- err
+			return
+		}
+		waitStatus <- exitCode
+	}()
+
+	select {
+	case <-ctx.Done():
+		c.docker.StopContainer(container.ID, 0)
+		return ctx.Err()
+	case err := <-waitErr:
+		return fmt.Errorf("wait container: %v", err)
+	case exitCode := <-waitStatus:
+		<-attached
+		if exitCode != 0 {
+			return &postBuildExitError{ExitCode: exitCode}
+		}
+		return nil
+	}
+}
+
+// postBuildExitError indicates that opts.PostBuild ran and exited with a
+// non-zero status, as opposed to an infrastructure error talking to the
+// docker daemon. Build uses this to tell the two apart when reporting a
+// commit status.
+type postBuildExitError struct {
+	ExitCode int
+}
+
+func (e *postBuildExitError) Error() string {
+	return fmt.Sprintf("post-build command exited with status %d", e.ExitCode)
 }
 
 // push pushes the image to the docker registry.
-func (c *Conveyor) push(image string, w io.Writer, tags ...string) error {
+func (c *Conveyor) push(ctx context.Context, image string, w io.Writer, tags ...string) error {
+	auths, err := c.AuthFn(image)
+	if err != nil {
+		return fmt.Errorf("auth: %v", err)
+	}
+	if len(auths) == 0 {
+		auths = []docker.AuthConfiguration{{}}
+	}
+
 	for _, t := range tags {
-		if err := c.docker.PushImage(docker.PushImageOptions{
-			Name:         image,
-			Tag:          t,
-			OutputStream: w,
-		}, c.AuthConfiguration); err != nil {
-			return err
+		var pushErr error
+		for _, auth := range auths {
+			pushErr = c.docker.PushImage(docker.PushImageOptions{
+				Context:      ctx,
+				Name:         image,
+				Tag:          t,
+				OutputStream: w,
+			}, auth)
+			if !unauthorized(pushErr) {
+				break
+			}
+		}
+		if pushErr != nil {
+			return pushErr
 		}
 	}
 
@@ -198,20 +402,34 @@ func (c *Conveyor) tag(image string, tags ...string) error {
 	return nil
 }
 
+// setStatus updates the commit status for a single stage of the build,
+// linking it to opts.LogURL so the stage can be diagnosed from the PR page.
+func (c *Conveyor) setStatus(opts BuildOptions, context, state, description string) error {
+	return c.updateStatus(opts.Repository, opts.Commit, context, state, description, opts.LogURL)
+}
+
 // updateStatus updates the given commit with a new status.
-func (c *Conveyor) updateStatus(repo, commit, status string) error {
-	context := Context
-	parts := strings.SplitN(repo, "/", 2)
-	_, _, err := c.github.CreateStatus(parts[0], parts[1], commit, &github.RepoStatus{
-		State:   &status,
+func (c *Conveyor) updateStatus(repo, commit, context, state, description, targetURL string) error {
+	status := &github.RepoStatus{
+		State:   &state,
 		Context: &context,
-	})
+	}
+	if description != "" {
+		status.Description = &description
+	}
+	if targetURL != "" {
+		status.TargetURL = &targetURL
+	}
+
+	parts := strings.SplitN(repo, "/", 2)
+	_, _, err := c.github.CreateStatus(parts[0], parts[1], commit, status)
 	return err
 }
 
-// newCommand returns an exec.Cmd that writes to Stdout and Stderr.
-func newCommand(w io.Writer, name string, arg ...string) *exec.Cmd {
-	cmd := exec.Command(name, arg...)
+// newCommandContext returns an exec.Cmd that writes to Stdout and Stderr,
+// and is killed if ctx is canceled.
+func newCommandContext(ctx context.Context, w io.Writer, name string, arg ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, arg...)
 	cmd.Stdout = w
 	cmd.Stderr = w
 	return cmd
@@ -223,28 +441,11 @@ func tagNotFound(err error) bool {
 	return tagNotFoundRegex.MatchString(err.Error())
 }
 
-// githubClient represents a client that can create github commit statuses.
-type githubClient interface {
-	CreateStatus(owner, repo, ref string, status *github.RepoStatus) (*github.RepoStatus, *github.Response, error)
-}
+var unauthorizedRegex = regexp.MustCompile(`(?i)unauthorized|401`)
 
-// newGitHubClient returns a new githubClient instance. If token is an empty
-// string, then a fake client will be returned.
-func newGitHubClient(token string) githubClient {
-	if token == "" {
-		return &nullGitHubClient{}
-	}
-
-	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
-	tc := oauth2.NewClient(oauth2.NoContext, ts)
-	return github.NewClient(tc).Repositories
+// unauthorized returns true if err looks like a registry authentication
+// failure, so the caller can retry with the next set of credentials.
+func unauthorized(err error) bool {
+	return err != nil && unauthorizedRegex.MatchString(err.Error())
 }
 
-// nullGitHubClient is an implementation of the githubClient interface that does
-// nothing.
-type nullGitHubClient struct{}
-
-func (c *nullGitHubClient) CreateStatus(owner, repo, ref string, status *github.RepoStatus) (*github.RepoStatus, *github.Response, error) {
-	fmt.Printf("Updating status of %s on %s/%s to %s\n", ref, owner, repo, *status.State)
-	return nil, nil, nil
-}
\ No newline at end of file
@@ -0,0 +1,164 @@
+package conveyor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+// githubClient represents a client that can create github commit statuses.
+type githubClient interface {
+	CreateStatus(owner, repo, ref string, status *github.RepoStatus) (*github.RepoStatus, *github.Response, error)
+}
+
+// newGitHubClientFromEnv returns a githubClient configured from the
+// environment. It prefers GitHub App installation credentials
+// (GITHUB_APP_ID, GITHUB_APP_INSTALLATION_ID, GITHUB_APP_PRIVATE_KEY_PATH)
+// over a static personal access token (GITHUB_TOKEN), since a PAT doesn't
+// scale to org-wide installs. If neither is configured, a fake client that
+// just logs is returned.
+func newGitHubClientFromEnv() githubClient {
+	if appID := os.Getenv("GITHUB_APP_ID"); appID != "" {
+		cfg, err := gitHubAppConfigFromEnv(appID)
+		if err != nil {
+			fmt.Printf("github app: %v\n", err)
+			return &nullGitHubClient{}
+		}
+		return newGitHubAppClient(cfg)
+	}
+
+	return newGitHubClient(os.Getenv("GITHUB_TOKEN"))
+}
+
+// newGitHubClient returns a new githubClient instance authenticated with a
+// static personal access token. If token is an empty string, then a fake
+// client will be returned.
+func newGitHubClient(token string) githubClient {
+	if token == "" {
+		return &nullGitHubClient{}
+	}
+
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+	tc := oauth2.NewClient(oauth2.NoContext, ts)
+	return github.NewClient(tc).Repositories
+}
+
+// nullGitHubClient is an implementation of the githubClient interface that does
+// nothing.
+type nullGitHubClient struct{}
+
+func (c *nullGitHubClient) CreateStatus(owner, repo, ref string, status *github.RepoStatus) (*github.RepoStatus, *github.Response, error) {
+	fmt.Printf("Updating status of %s on %s/%s to %s\n", ref, owner, repo, *status.State)
+	return nil, nil, nil
+}
+
+// GitHubAppConfig configures authentication as a GitHub App installation.
+type GitHubAppConfig struct {
+	// AppID is the GitHub App's numeric id.
+	AppID int64
+	// InstallationID is the id of the installation to act as.
+	InstallationID int64
+	// PrivateKey is the app's PEM encoded RSA private key, used to sign
+	// the JWT that's exchanged for installation tokens.
+	PrivateKey []byte
+}
+
+func gitHubAppConfigFromEnv(appID string) (GitHubAppConfig, error) {
+	id, err := strconv.ParseInt(appID, 10, 64)
+	if err != nil {
+		return GitHubAppConfig{}, fmt.Errorf("GITHUB_APP_ID: %v", err)
+	}
+
+	installationID, err := strconv.ParseInt(os.Getenv("GITHUB_APP_INSTALLATION_ID"), 10, 64)
+	if err != nil {
+		return GitHubAppConfig{}, fmt.Errorf("GITHUB_APP_INSTALLATION_ID: %v", err)
+	}
+
+	key, err := ioutil.ReadFile(os.Getenv("GITHUB_APP_PRIVATE_KEY_PATH"))
+	if err != nil {
+		return GitHubAppConfig{}, fmt.Errorf("GITHUB_APP_PRIVATE_KEY_PATH: %v", err)
+	}
+
+	return GitHubAppConfig{
+		AppID:          id,
+		InstallationID: installationID,
+		PrivateKey:     key,
+	}, nil
+}
+
+// newGitHubAppClient returns a githubClient that authenticates as a GitHub
+// App installation, exchanging a JWT signed with the app's private key for
+// a short-lived installation token, and refreshing it as it expires.
+func newGitHubAppClient(cfg GitHubAppConfig) githubClient {
+	tc := oauth2.NewClient(oauth2.NoContext, &installationTokenSource{config: cfg})
+	return github.NewClient(tc).Repositories
+}
+
+// installationTokenSource is an oauth2.TokenSource that exchanges a JWT
+// signed with a GitHub App's private key for an installation access token,
+// refreshing it shortly before it expires.
+type installationTokenSource struct {
+	config GitHubAppConfig
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func (s *installationTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != nil && s.token.Expiry.After(time.Now().Add(time.Minute)) {
+		return s.token, nil
+	}
+
+	jwt, err := s.signedJWT()
+	if err != nil {
+		return nil, fmt.Errorf("sign jwt: %v", err)
+	}
+
+	jwtClient := oauth2.NewClient(oauth2.NoContext, oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: jwt,
+		TokenType:   "Bearer",
+	}))
+
+	installationToken, _, err := github.NewClient(jwtClient).Apps.CreateInstallationToken(context.Background(), s.config.InstallationID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create installation token: %v", err)
+	}
+
+	s.token = &oauth2.Token{
+		AccessToken: installationToken.GetToken(),
+		Expiry:      installationToken.GetExpiresAt(),
+	}
+
+	return s.token, nil
+}
+
+// signedJWT returns a JWT, signed with the app's private key, that
+// identifies conveyor as the GitHub App with id config.AppID. This is the
+// same JWT-as-app-identity dance the GitHub CLI and other App integrations
+// use to mint installation tokens.
+func (s *installationTokenSource) signedJWT() (string, error) {
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(s.config.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("parse private key: %v", err)
+	}
+
+	now := time.Now()
+	claims := jwt.StandardClaims{
+		IssuedAt:  now.Add(-time.Minute).Unix(),
+		ExpiresAt: now.Add(10 * time.Minute).Unix(),
+		Issuer:    strconv.FormatInt(s.config.AppID, 10),
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+}
@@ -0,0 +1,19 @@
+package conveyor
+
+import "io"
+
+// Logs creates the per-build log that Build streams output to, and resolves
+// its public url so it can be linked from the commit status as
+// BuildOptions.LogURL. Satisfied by *s3.Logs (see logs/s3).
+type Logs interface {
+	// Create returns a writer for the named build's log. Closing it
+	// finalizes the log, e.g. stitching together a multipart upload.
+	Create(name string) (io.WriteCloser, error)
+	// URL returns the named build's log's public url.
+	URL(name string) string
+}
+
+// logName returns the key a build's log is stored under.
+func logName(opts BuildOptions) string {
+	return opts.Repository + "/" + opts.Commit
+}
@@ -2,22 +2,47 @@ package s3
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"io"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
-// Logs returns a builder.Logs implementation that reads and writes logs to s3
-// files.
+const (
+	// DefaultPartSize is the default number of bytes that are buffered
+	// before a part is flushed to s3.
+	DefaultPartSize = 5 * 1024 * 1024 // 5MB, s3's minimum part size.
+
+	// DefaultFlushInterval is the default amount of time output will be
+	// buffered before being flushed to s3, even if PartSize hasn't been
+	// reached, so that an in-progress build has fresh output to tail.
+	DefaultFlushInterval = 5 * time.Second
+
+	// pollInterval is how often Tail checks s3 for new parts.
+	pollInterval = 2 * time.Second
+)
+
+// Logs returns a builder.Logs implementation that reads and writes logs to
+// s3 files.
 type Logs struct {
 	// Bucket that the log files will be stored in.
 	Bucket string
 
+	// PartSize is the number of bytes that are buffered before a part
+	// is flushed to s3. Defaults to DefaultPartSize.
+	PartSize int
+
+	// FlushInterval is the maximum amount of time output is buffered
+	// before being flushed to s3, even if PartSize hasn't been reached.
+	// Defaults to DefaultFlushInterval.
+	FlushInterval time.Duration
+
 	client *s3.S3
 }
 
@@ -28,43 +53,350 @@ func NewLogger(config client.ConfigProvider, bucket string) *Logs {
 	}
 }
 
-func (l *Logs) Create(name string) (io.Writer, error) {
-	name = filepath.Join("logs", fmt.Sprintf("%s.txt", name))
+func (l *Logs) Create(name string) (io.WriteCloser, error) {
+	partSize, flushInterval := l.PartSize, l.FlushInterval
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
+	}
 
-	return &writer{
-		bucket: l.Bucket,
-		name:   name,
-		client: l.client,
-		b:      new(bytes.Buffer),
-	}, nil
+	return newWriter(l.client, l.Bucket, name, partSize, flushInterval), nil
 }
 
+// Open returns an io.Reader that streams the completed log's contents from
+// s3.
 func (l *Logs) Open(name string) (io.Reader, error) {
-	return nil, errors.New("s3 logs: read is not implemented yet")
+	out, err := l.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(l.Bucket),
+		Key:    aws.String(objectKey(name)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Body, nil
+}
+
+// URL returns the public url of the named log object, suitable for use as
+// a commit status target_url.
+func (l *Logs) URL(name string) string {
+	return fmt.Sprintf("https://s3.amazonaws.com/%s/%s", l.Bucket, objectKey(name))
+}
+
+// Tail returns an io.ReadCloser that streams a log as it's written, polling
+// s3 for new parts until the upload is completed. This lets a web UI follow
+// an in-progress build.
+func (l *Logs) Tail(name string) (io.ReadCloser, error) {
+	return newTailReader(l.client, l.Bucket, name), nil
+}
+
+func objectKey(name string) string {
+	return filepath.Join("logs", fmt.Sprintf("%s.txt", name))
+}
+
+func partKey(name string, part int64) string {
+	return filepath.Join("logs", name, fmt.Sprintf("part-%08d.txt", part))
 }
 
-// writer is an io.WriteCloser implementation that buffers up the bytes until
-// Close is called, then flushes the data to a file in s3.
+// writer is an io.WriteCloser implementation that buffers bytes and
+// periodically flushes them to s3 as a part, then stitches the parts
+// together into a single object on Close. Flushing parts as they're
+// written, rather than buffering the whole log in memory until Close,
+// keeps memory usage bounded on long builds and is what makes Tail
+// possible.
 type writer struct {
-	// Data will be buffered here.
-	b *bytes.Buffer
+	bucket, name  string
+	client        *s3.S3
+	partSize      int
+	flushInterval time.Duration
 
-	bucket, name string
-	client       *s3.S3
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	partNum int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newWriter(client *s3.S3, bucket, name string, partSize int, flushInterval time.Duration) *writer {
+	w := &writer{
+		bucket:        bucket,
+		name:          name,
+		client:        client,
+		partSize:      partSize,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go w.flushLoop()
+
+	return w
+}
+
+func (w *writer) flushLoop() {
+	defer w.wg.Done()
+
+	t := time.NewTicker(w.flushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			w.flush()
+		case <-w.done:
+			return
+		}
+	}
 }
 
-func (l *writer) Write(p []byte) (int, error) {
-	return l.b.Write(p)
+func (w *writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	n, err := w.buf.Write(p)
+	full := w.buf.Len() >= w.partSize
+	w.mu.Unlock()
+	if err != nil {
+		return n, err
+	}
+
+	if full {
+		if err := w.flush(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
 }
 
-func (l *writer) Close() error {
-	_, err := l.client.PutObject(&s3.PutObjectInput{
-		Bucket:        aws.String(l.bucket),
-		Key:           aws.String(l.name),
+// flush uploads any buffered bytes as the next part.
+func (w *writer) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	w.partNum++
+	key := partKey(w.name, w.partNum)
+	data := w.buf.Bytes()
+
+	_, err := w.client.PutObject(&s3.PutObjectInput{
+		Bucket:        aws.String(w.bucket),
+		Key:           aws.String(key),
 		ACL:           aws.String("public-read"),
-		Body:          bytes.NewReader(l.b.Bytes()),
-		ContentLength: aws.Int64(int64(l.b.Len())),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
 		ContentType:   aws.String("text/plain"),
 	})
-	return err
+	if err != nil {
+		return fmt.Errorf("upload part %d: %v", w.partNum, err)
+	}
+
+	w.buf.Reset()
+	return nil
+}
+
+// Close flushes any remaining buffered bytes, then concatenates all of the
+// parts into a single logs/<name>.txt object via a multipart upload, so
+// that Open doesn't need to know about the part scheme Write and Tail use.
+func (w *writer) Close() error {
+	close(w.done)
+	w.wg.Wait()
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	lastPart := w.partNum
+	w.mu.Unlock()
+
+	key := objectKey(w.name)
+
+	if lastPart == 0 {
+		_, err := w.client.PutObject(&s3.PutObjectInput{
+			Bucket:        aws.String(w.bucket),
+			Key:           aws.String(key),
+			ACL:           aws.String("public-read"),
+			Body:          bytes.NewReader(nil),
+			ContentLength: aws.Int64(0),
+			ContentType:   aws.String("text/plain"),
+		})
+		return err
+	}
+
+	created, err := w.client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(w.bucket),
+		Key:         aws.String(key),
+		ACL:         aws.String("public-read"),
+		ContentType: aws.String("text/plain"),
+	})
+	if err != nil {
+		return fmt.Errorf("create multipart upload: %v", err)
+	}
+
+	var parts []*s3.CompletedPart
+	for n := int64(1); n <= lastPart; n++ {
+		copied, err := w.client.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:     aws.String(w.bucket),
+			Key:        aws.String(key),
+			UploadId:   created.UploadId,
+			PartNumber: aws.Int64(n),
+			CopySource: aws.String(fmt.Sprintf("%s/%s", w.bucket, partKey(w.name, n))),
+		})
+		if err != nil {
+			return fmt.Errorf("copy part %d: %v", n, err)
+		}
+
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       copied.CopyPartResult.ETag,
+			PartNumber: aws.Int64(n),
+		})
+	}
+
+	if _, err := w.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(w.bucket),
+		Key:      aws.String(key),
+		UploadId: created.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: parts,
+		},
+	}); err != nil {
+		return fmt.Errorf("complete multipart upload: %v", err)
+	}
+
+	for n := int64(1); n <= lastPart; n++ {
+		w.client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(w.bucket),
+			Key:    aws.String(partKey(w.name, n)),
+		})
+	}
+
+	return nil
+}
+
+// tailReader is an io.ReadCloser that polls s3 for new parts of a log
+// that's still being written, falling back to the completed object once
+// the writer has stitched the parts together.
+type tailReader struct {
+	client       *s3.S3
+	bucket, name string
+
+	closed chan struct{}
+	once   sync.Once
+
+	buf      bytes.Buffer
+	nextPart int64
+	// offset is how many bytes have already been pulled from parts (or
+	// the completed object), so that once parts run out we resume the
+	// completed object from where we left off instead of re-streaming
+	// everything from byte 0.
+	offset int64
+	done   bool
+}
+
+func newTailReader(client *s3.S3, bucket, name string) *tailReader {
+	return &tailReader{
+		client:   client,
+		bucket:   bucket,
+		name:     name,
+		nextPart: 1,
+		closed:   make(chan struct{}),
+	}
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	for t.buf.Len() == 0 && !t.done {
+		if err := t.poll(); err != nil {
+			return 0, err
+		}
+
+		if t.buf.Len() == 0 && !t.done {
+			select {
+			case <-t.closed:
+				return 0, io.EOF
+			case <-time.After(pollInterval):
+			}
+		}
+	}
+
+	if t.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	return t.buf.Read(p)
+}
+
+// poll fetches the next unread part, or the completed object if the writer
+// has finished and stitched the parts together. The completed object is the
+// concatenation of every part, in order, so once parts run out we range-GET
+// the completed object starting at the offset we've already streamed,
+// rather than re-copying it from the start.
+func (t *tailReader) poll() error {
+	out, err := t.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(partKey(t.name, t.nextPart)),
+	})
+	if err == nil {
+		defer out.Body.Close()
+		n, err := io.Copy(&t.buf, out.Body)
+		if err != nil {
+			return err
+		}
+		t.offset += n
+		t.nextPart++
+		return nil
+	}
+	if !isNotFound(err) {
+		return err
+	}
+
+	// No more parts; see if the log has been completed.
+	out, err = t.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(objectKey(t.name)),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-", t.offset)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		if isInvalidRange(err) {
+			// We're already caught up with the completed object.
+			t.done = true
+			return nil
+		}
+		return err
+	}
+	defer out.Body.Close()
+
+	n, err := io.Copy(&t.buf, out.Body)
+	if err != nil {
+		return err
+	}
+	t.offset += n
+	t.done = true
+	return nil
+}
+
+func (t *tailReader) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
+	}
+	return false
+}
+
+func isInvalidRange(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "InvalidRange"
+	}
+	return false
 }
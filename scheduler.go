@@ -0,0 +1,168 @@
+package conveyor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Scheduler runs builds concurrently, up to a configurable limit, and
+// deduplicates in-flight builds for the same repository and commit. It
+// turns a Conveyor, which only knows how to run a single build, into a
+// multi-tenant build service.
+type Scheduler struct {
+	// Conveyor performs the actual build.
+	Conveyor *Conveyor
+	// Concurrency is the maximum number of builds that can run at once.
+	// Defaults to 1.
+	Concurrency int
+
+	once sync.Once
+	jobs chan schedulerJob
+
+	mu       sync.Mutex
+	inFlight map[string]*inFlightBuild
+}
+
+type schedulerJob struct {
+	ctx  context.Context
+	opts BuildOptions
+	done chan error
+}
+
+// inFlightBuild tracks a running build so that duplicate requests for the
+// same repository and commit can wait on it instead of starting a second,
+// redundant build. The build itself runs with its own context, independent
+// of any single caller's, so one caller disconnecting can't kill a build
+// that other callers are still waiting on; cancel is only called once every
+// attached caller has given up.
+type inFlightBuild struct {
+	done   chan struct{}
+	err    error
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	waiters int
+}
+
+func (b *inFlightBuild) addWaiter() {
+	b.mu.Lock()
+	b.waiters++
+	b.mu.Unlock()
+}
+
+// removeWaiter decrements the waiter count, canceling the build if no
+// caller is left waiting on its result.
+func (b *inFlightBuild) removeWaiter() {
+	b.mu.Lock()
+	b.waiters--
+	abandoned := b.waiters == 0
+	b.mu.Unlock()
+
+	if abandoned {
+		b.cancel()
+	}
+}
+
+// Build schedules opts to run on the next available worker, and blocks
+// until the build finishes or ctx is canceled. If a build for the same
+// repository and commit is already running, this waits on that build
+// instead of starting a second one; the build keeps running even if this
+// caller's ctx is canceled, as long as another caller is still waiting on
+// it.
+func (s *Scheduler) Build(ctx context.Context, opts BuildOptions) error {
+	s.once.Do(s.start)
+
+	key := buildKey(opts.Repository, opts.Commit)
+
+	s.mu.Lock()
+	b, ok := s.inFlight[key]
+	if !ok {
+		buildCtx, cancel := context.WithCancel(context.Background())
+		b = &inFlightBuild{done: make(chan struct{}), cancel: cancel}
+		s.inFlight[key] = b
+		b.addWaiter()
+		s.mu.Unlock()
+
+		go s.run(key, b, buildCtx, opts)
+	} else {
+		b.addWaiter()
+		s.mu.Unlock()
+	}
+
+	defer b.removeWaiter()
+
+	select {
+	case <-b.done:
+		return b.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run submits opts as a job and waits for it to complete, independent of
+// any individual caller's context, so that Scheduler.Build callers can come
+// and go without affecting the build they're attached to.
+func (s *Scheduler) run(key string, b *inFlightBuild, ctx context.Context, opts BuildOptions) {
+	done := make(chan error, 1)
+	select {
+	case s.jobs <- schedulerJob{ctx: ctx, opts: opts, done: done}:
+		b.err = <-done
+	case <-ctx.Done():
+		b.err = ctx.Err()
+	}
+	close(b.done)
+
+	s.mu.Lock()
+	delete(s.inFlight, key)
+	s.mu.Unlock()
+}
+
+func (s *Scheduler) start() {
+	concurrency := s.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	s.jobs = make(chan schedulerJob)
+	s.inFlight = make(map[string]*inFlightBuild)
+
+	for i := 0; i < concurrency; i++ {
+		go s.worker()
+	}
+}
+
+func (s *Scheduler) worker() {
+	for job := range s.jobs {
+		job.done <- s.Conveyor.Build(job.ctx, job.opts)
+	}
+}
+
+func buildKey(repository, commit string) string {
+	return fmt.Sprintf("%s@%s", repository, commit)
+}
+
+// ServeHTTP implements http.Handler, accepting a JSON encoded BuildOptions
+// as the request body and scheduling it to build. The request is held open
+// until the build finishes, is canceled by the client disconnecting, or the
+// request's context is otherwise canceled.
+func (s *Scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var opts BuildOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.OutputStream = w
+
+	if err := s.Build(r.Context(), opts); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
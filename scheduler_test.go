@@ -0,0 +1,24 @@
+package conveyor
+
+import "testing"
+
+func TestInFlightBuild_CancelsOnlyWhenLastWaiterLeaves(t *testing.T) {
+	var canceled bool
+	b := &inFlightBuild{
+		done:   make(chan struct{}),
+		cancel: func() { canceled = true },
+	}
+
+	b.addWaiter()
+	b.addWaiter()
+
+	b.removeWaiter()
+	if canceled {
+		t.Fatal("canceled with a waiter still attached")
+	}
+
+	b.removeWaiter()
+	if !canceled {
+		t.Fatal("expected cancel once the last waiter left")
+	}
+}
@@ -0,0 +1,65 @@
+package conveyor
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Squasher flattens a built image down to a single layer.
+type Squasher interface {
+	// Squash exports the image with the given id, collapses its layers
+	// into one, and re-imports it, returning the id of the new image.
+	Squash(ctx context.Context, imageID string, w io.Writer) (string, error)
+}
+
+// dockerSquasher is a Squasher implementation that uses the docker client to
+// flatten an image by committing a throwaway container started from it.
+type dockerSquasher struct {
+	docker *docker.Client
+}
+
+func newDockerSquasher(c *docker.Client) *dockerSquasher {
+	return &dockerSquasher{docker: c}
+}
+
+func (s *dockerSquasher) Squash(ctx context.Context, imageID string, w io.Writer) (string, error) {
+	info, err := s.docker.InspectImage(imageID)
+	if err != nil {
+		return "", fmt.Errorf("inspect: %v", err)
+	}
+
+	// Committing a throwaway container, rather than exporting and
+	// re-importing the image, is what actually flattens it down to a
+	// single layer: the container's filesystem is already the merged,
+	// whiteout-resolved view, and CommitContainer lets us hand the
+	// original config straight back in via Run, instead of translating it
+	// into --change directives for ImportImage (which has no Changes
+	// field to begin with).
+	container, err := s.docker.CreateContainer(docker.CreateContainerOptions{
+		Context: ctx,
+		Config:  &docker.Config{Image: imageID},
+	})
+	if err != nil {
+		return "", fmt.Errorf("create container: %v", err)
+	}
+	defer s.docker.RemoveContainer(docker.RemoveContainerOptions{
+		ID:    container.ID,
+		Force: true,
+	})
+
+	repository := fmt.Sprintf("squash-%.12s", imageID)
+	squashed, err := s.docker.CommitContainer(docker.CommitContainerOptions{
+		Context:    ctx,
+		Container:  container.ID,
+		Repository: repository,
+		Run:        info.Config,
+	})
+	if err != nil {
+		return "", fmt.Errorf("commit: %v", err)
+	}
+
+	return squashed.ID, nil
+}